@@ -14,11 +14,13 @@
 package js
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 
@@ -40,10 +42,294 @@ import (
 	"github.com/gohugoio/hugo/resources"
 )
 
+// nsImportHugo is the esbuild namespace used for the imports that Hugo
+// resolves itself, e.g. imports of other Hugo Resources.
+const nsImportHugo = "ns-hugo"
+
+// Options esbuild configuration.
+type Options struct {
+	// If not set, the source path will be used as the base target path.
+	// Note that the target path's extension may change if the target MediaType
+	// is different, e.g. when the source is TypeScript.
+	TargetPath string
+
+	// Whether to create a source map.
+	// One of: inline, external.
+	SourceMap string
+
+	// The language target.
+	// One of: es5, es2015, es2016, es2017, es2018, es2019, es2020, es2021, es2022, es2023, esnext.
+	// Default is esnext.
+	Target string
+
+	// The output format.
+	// One of: iife, cjs, esm.
+	// Default is iife.
+	Format string
+
+	// Whether to minify to output.
+	Minify bool
+
+	// Avoid a temporal dead zone issue in certain cases where esbuild's
+	// const-to-var downleveling interacts badly with a bundler further down
+	// the chain. See https://github.com/evanw/esbuild/issues/1842.
+	AvoidTDZ bool
+
+	// The JSX mode.
+	// One of: transform, preserve, automatic.
+	JSX string
+
+	// Which library to use to automatically import JSX helper functions from.
+	// Only relevant when JSX is "automatic".
+	JSXImportSource string
+
+	// Relative paths, e.g. "./vars.js", to scripts that gets injected to the top
+	// of the bundle.
+	Inject []string
+
+	// Whether to emit esbuild's metafile (inputs, outputs and their sizes) as
+	// JSON. See Client.LastMetafile.
+	Metafile bool
+
+	// The target path, relative to the publish directory, to publish the
+	// metafile to. Defaults to "metafile.json" next to the built resource
+	// when Metafile is enabled.
+	MetafilePath string
+
+	// Plugins holds esbuild plugins to run for this build, in addition to any
+	// registered on the Client with RegisterPlugin.
+	Plugins []api.Plugin
+
+	// Whether to reuse an esbuild build context (see Client.contexts) across
+	// builds with the same entry points and options, calling Rebuild instead
+	// of doing a full build every time. Mainly useful with the server's
+	// watch mode, where rebuild latency matters more than it does for a
+	// one-off `hugo` build.
+	//
+	// This only covers reusing esbuild's own context; it does not invalidate
+	// that context when a file under /assets changes, and it does not feed
+	// esbuild's per-build dependency list back into Hugo's resource cache to
+	// scope rebuilds to touched entry points. Wiring either of those in is
+	// left to the caller (e.g. by calling InvalidateIncremental on a watch
+	// event) until Hugo's own watch loop and resource cache grow support for
+	// it.
+	Incremental bool
+
+	resolveDir string
+	tsConfig   string
+}
+
+func decodeOptions(m map[string]any) (Options, error) {
+	var opts Options
+
+	if err := mapstructure.WeakDecode(m, &opts); err != nil {
+		return opts, err
+	}
+
+	opts.Target = strings.ToLower(opts.Target)
+	opts.Format = strings.ToLower(opts.Format)
+	opts.SourceMap = strings.ToLower(opts.SourceMap)
+	opts.JSX = strings.ToLower(opts.JSX)
+
+	if opts.TargetPath != "" {
+		opts.TargetPath = filepath.ToSlash(opts.TargetPath)
+	}
+
+	return opts, nil
+}
+
+func toBuildOptions(opts Options) (api.BuildOptions, error) {
+	var target api.Target
+
+	switch opts.Target {
+	case "es5":
+		target = api.ES5
+	case "es2015":
+		target = api.ES2015
+	case "es2016":
+		target = api.ES2016
+	case "es2017":
+		target = api.ES2017
+	case "es2018":
+		target = api.ES2018
+	case "es2019":
+		target = api.ES2019
+	case "es2020":
+		target = api.ES2020
+	case "es2021":
+		target = api.ES2021
+	case "es2022":
+		target = api.ES2022
+	case "es2023":
+		target = api.ES2023
+	case "", "esnext":
+		target = api.ESNext
+	default:
+		return api.BuildOptions{}, fmt.Errorf("invalid target: %q", opts.Target)
+	}
+
+	var format api.Format
+
+	switch opts.Format {
+	case "", "iife":
+		format = api.FormatIIFE
+	case "cjs":
+		format = api.FormatCommonJS
+	case "esm":
+		format = api.FormatESModule
+	default:
+		return api.BuildOptions{}, fmt.Errorf("invalid format: %q", opts.Format)
+	}
+
+	buildOptions := api.BuildOptions{
+		Bundle: true,
+		Target: target,
+		Format: format,
+
+		MinifyWhitespace:  opts.Minify,
+		MinifyIdentifiers: opts.Minify,
+		MinifySyntax:      opts.Minify,
+
+		Metafile: opts.Metafile,
+
+		Plugins: opts.Plugins,
+	}
+
+	if opts.SourceMap != "" {
+		switch opts.SourceMap {
+		case "inline":
+			buildOptions.Sourcemap = api.SourceMapInline
+		case "external":
+			buildOptions.Sourcemap = api.SourceMapExternal
+		default:
+			return api.BuildOptions{}, fmt.Errorf("invalid sourcemap: %q", opts.SourceMap)
+		}
+	}
+
+	if opts.JSX != "" {
+		switch opts.JSX {
+		case "automatic":
+			buildOptions.JSX = api.JSXAutomatic
+		case "preserve":
+			buildOptions.JSX = api.JSXPreserve
+		case "transform":
+			buildOptions.JSX = api.JSXTransform
+		default:
+			return api.BuildOptions{}, fmt.Errorf("invalid jsx: %q", opts.JSX)
+		}
+	}
+	buildOptions.JSXImportSource = opts.JSXImportSource
+
+	if opts.AvoidTDZ && format == api.FormatESModule {
+		// esbuild's const-to-var downleveling can reintroduce the temporal
+		// dead zone bug it's meant to avoid once the ESM output is bundled a
+		// second time downstream, so leave const/let alone in that case.
+		buildOptions.Supported = map[string]bool{"const-and-let": false}
+	}
+
+	if opts.resolveDir != "" {
+		buildOptions.AbsWorkingDir = opts.resolveDir
+	}
+
+	if opts.tsConfig != "" {
+		buildOptions.Tsconfig = opts.tsConfig
+	}
+
+	return buildOptions, nil
+}
+
+// namespaceFromPath splits an esbuild virtual path such as "virtual:foo.js"
+// into its plugin namespace ("virtual") and the remainder ("foo.js"). It
+// returns ok=false for ordinary filesystem paths, including Windows paths
+// such as `C:\foo.js`, whose single-letter prefix is a drive, not a
+// namespace.
+func namespaceFromPath(path string) (ns string, rest string, ok bool) {
+	ns, rest, ok = strings.Cut(path, ":")
+	if !ok || len(ns) < 2 {
+		return "", path, false
+	}
+	return ns, rest, true
+}
+
+// buildTransformation is kept around to pin the "jsbuild" resource
+// transformation cache key. Changing it is sometimes needed, but should be
+// avoided if possible; see options_test.go.
+type buildTransformation struct {
+	optsm map[string]any
+}
+
+func (t *buildTransformation) Key() internal.ResourceTransformationKey {
+	return internal.NewResourceTransformationKey("jsbuild", t.optsm)
+}
+
+// resolveComponentInAssets resolves impPath to a component in the assets
+// filesystem, trying the original path verbatim, then with the usual
+// JS/TS extensions appended, then as a directory with an index file of
+// its own (preferring a plain "index" over an "index.esm" file).
+func resolveComponentInAssets(fs afero.Fs, impPath string) *hugofs.FileMeta {
+	findFirst := func(name string) *hugofs.FileMeta {
+		fi, err := fs.Stat(name)
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		return fi.(hugofs.FileMetaInfo).Meta()
+	}
+
+	if filepath.Ext(impPath) != "" {
+		return findFirst(impPath)
+	}
+
+	if m := findFirst(impPath); m != nil {
+		return m
+	}
+
+	for _, ext := range resolveExtensions {
+		if m := findFirst(impPath + ext); m != nil {
+			return m
+		}
+	}
+
+	indexPath := filepath.Join(impPath, "index")
+	for _, ext := range resolveExtensions {
+		if m := findFirst(indexPath + ext); m != nil {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// resolveExtensions is the list of extensions tried, in order, when an
+// import path doesn't resolve verbatim. "index.esm.js" is deliberately last
+// so a plain "index.js" always wins when both exist.
+var resolveExtensions = []string{".js", ".jsx", ".ts", ".tsx", ".esm.js"}
+
 // Client context for ESBuild.
 type Client struct {
 	rs  *resources.Spec
 	sfs *filesystems.SourceFilesystem
+
+	metafileMu   sync.RWMutex
+	lastMetafile string
+
+	pluginsMu sync.RWMutex
+	plugins   []api.Plugin
+
+	// contexts holds one esbuild build context per distinct entry-point set
+	// and options, keyed by the same kind of cache key used for the
+	// resource cache, so Options.Incremental builds can call Rebuild
+	// instead of building from scratch every time.
+	contextsMu sync.Mutex
+	contexts   map[string]*incrementalContext
+}
+
+// incrementalContext pairs a cached esbuild build context with the Outdir it
+// was created with. Outdir is baked into the context at api.Context time and
+// is reused by every Rebuild call, so callers must key off this stored value
+// rather than generating a new one per Transform call.
+type incrementalContext struct {
+	ctx    api.BuildContext
+	outdir string
 }
 
 // New creates a new client context.
@@ -54,6 +340,131 @@ func New(fs *filesystems.SourceFilesystem, rs *resources.Spec) *Client {
 	}
 }
 
+// RegisterPlugin adds one or more esbuild plugins that will run, in
+// addition to any passed in Options.Plugins, for every subsequent Transform
+// call made through this Client.
+func (c *Client) RegisterPlugin(plugins ...api.Plugin) {
+	c.pluginsMu.Lock()
+	defer c.pluginsMu.Unlock()
+	c.plugins = append(c.plugins, plugins...)
+}
+
+// InvalidateIncremental drops any cached esbuild build context, forcing the
+// next Options.Incremental Transform call to start a fresh one. esbuild's
+// own Rebuild only re-reads files already in its dependency graph, not new
+// entry points or renames, so callers that watch for that kind of change
+// (e.g. a server rebuild loop) are responsible for calling this themselves;
+// nothing in this package calls it on its own.
+func (c *Client) InvalidateIncremental() {
+	c.Close()
+}
+
+// Close disposes of any esbuild build contexts created for
+// Options.Incremental builds, stopping their background goroutines. It is
+// safe to call even if no incremental builds were made. Callers that keep a
+// Client alive across a full build (e.g. on server shutdown) are
+// responsible for calling this themselves.
+func (c *Client) Close() error {
+	c.contextsMu.Lock()
+	defer c.contextsMu.Unlock()
+	for key, ic := range c.contexts {
+		ic.ctx.Dispose()
+		os.RemoveAll(ic.outdir)
+		delete(c.contexts, key)
+	}
+	return nil
+}
+
+// buildIncremental runs (or rebuilds) the esbuild build context cached
+// under ctxKey, creating one on a cache miss. It returns the build result
+// together with the Outdir that result's paths are relative to, since a
+// reused context's Rebuild result reports paths under the Outdir it was
+// originally created with rather than buildOptions.Outdir.
+//
+// contextsMu only guards the registry lookup/insert, not the Rebuild call
+// itself, so concurrent incremental builds for different cache keys (or
+// repeated rebuilds of the same one) don't serialize behind each other.
+func (c *Client) buildIncremental(buildOptions api.BuildOptions, ctxKey string) (api.BuildResult, string, error) {
+	c.contextsMu.Lock()
+	ic, ok := c.contexts[ctxKey]
+	if !ok {
+		outdir, err := os.MkdirTemp(os.TempDir(), "compileOutput")
+		if err != nil {
+			c.contextsMu.Unlock()
+			return api.BuildResult{}, "", err
+		}
+		buildOptions.Outdir = outdir
+
+		ctx, ctxErr := api.Context(buildOptions)
+		if ctxErr != nil {
+			c.contextsMu.Unlock()
+			os.RemoveAll(outdir)
+			return api.BuildResult{}, "", fmt.Errorf("failed to create esbuild context: %v", ctxErr.Errors)
+		}
+
+		ic = &incrementalContext{ctx: ctx, outdir: outdir}
+		if c.contexts == nil {
+			c.contexts = make(map[string]*incrementalContext)
+		}
+		c.contexts[ctxKey] = ic
+	}
+	c.contextsMu.Unlock()
+
+	return ic.ctx.Rebuild(), ic.outdir, nil
+}
+
+// toBuildError converts a single esbuild api.Message into an error, resolving
+// its Location back to the source file's filename and, where a file is available to
+// read from, wrapping it in an herrors.FileError so the line/column position
+// is reported to the user. Paths served by a plugin-registered namespace
+// (e.g. a virtual module) have no file on disk to read context from, but the
+// position is still reported against the virtual path.
+func (c *Client) toBuildError(msg api.Message) error {
+	loc := msg.Location
+	if loc == nil {
+		return errors.New(msg.Text)
+	}
+	path := loc.File
+
+	errorMessage := msg.Text
+
+	var (
+		f   afero.File
+		err error
+	)
+
+	if ns, rest, ok := namespaceFromPath(path); ok {
+		errorMessage = strings.ReplaceAll(errorMessage, ns+":", "")
+		path = rest
+
+		if ns == nsImportHugo {
+			f, err = hugofs.Os.Open(path)
+		}
+	} else {
+		var fi os.FileInfo
+		fi, err = c.sfs.Fs.Stat(path)
+		if err == nil {
+			m := fi.(hugofs.FileMetaInfo).Meta()
+			path = m.Filename
+			f, err = m.Open()
+		}
+	}
+
+	if err == nil {
+		fe := herrors.
+			NewFileErrorFromName(errors.New(errorMessage), path).
+			UpdatePosition(text.Position{Offset: -1, LineNumber: loc.Line, ColumnNumber: loc.Column}).
+			UpdateContent(f, nil)
+
+		if f != nil {
+			f.Close()
+		}
+		return fe
+	}
+
+	return fmt.Errorf("%s", errorMessage)
+}
+
 func (c *Client) Transform(optsm map[string]any, r []resources.ResourceTransformer, single bool) (resource.Resources, error) {
 	if len(r) == 0 {
 		return nil, nil
@@ -67,16 +478,14 @@ func (c *Client) Transform(optsm map[string]any, r []resources.ResourceTransform
 	opts.resolveDir = c.rs.Cfg.BaseConfig().WorkingDir // where node_modules gets resolved
 	opts.tsConfig = c.rs.ResolveJSConfigFile("tsconfig.json")
 
-	buildOptions, err := toBuildOptions(opts)
-	if err != nil {
-		return nil, err
-	}
+	c.pluginsMu.RLock()
+	opts.Plugins = append(append([]api.Plugin{}, c.plugins...), opts.Plugins...)
+	c.pluginsMu.RUnlock()
 
-	buildOptions.Outdir, err = os.MkdirTemp(os.TempDir(), "compileOutput")
+	buildOptions, err := toBuildOptions(opts)
 	if err != nil {
 		return nil, err
 	}
-	defer os.Remove(buildOptions.Outdir)
 
 	if opts.Inject != nil {
 		// Resolve the absolute filenames.
@@ -110,55 +519,44 @@ func (c *Client) Transform(optsm map[string]any, r []resources.ResourceTransform
 		buildOptions.EntryPoints = append(buildOptions.EntryPoints, m.Filename)
 	}
 
-	result := api.Build(buildOptions)
-
-	if len(result.Errors) > 0 {
-		createErr := func(msg api.Message) error {
-			loc := msg.Location
-			if loc == nil {
-				return errors.New(msg.Text)
-			}
-			path := loc.File
-
-			errorMessage := msg.Text
-			errorMessage = strings.ReplaceAll(errorMessage, nsImportHugo+":", "")
-
-			var (
-				f   afero.File
-				err error
-			)
-
-			if strings.HasPrefix(path, nsImportHugo) {
-				path = strings.TrimPrefix(path, nsImportHugo+":")
-				f, err = hugofs.Os.Open(path)
-			} else {
-				var fi os.FileInfo
-				fi, err = c.sfs.Fs.Stat(path)
-				if err == nil {
-					m := fi.(hugofs.FileMetaInfo).Meta()
-					path = m.Filename
-					f, err = m.Open()
-				}
+	// buildOutdir is the Outdir actually used for this build: a fresh temp
+	// dir for a one-off build, or the dir stashed alongside a reused
+	// incremental context. Everything below that matches esbuild's output
+	// paths (entryPointsMap, the OutputFiles prefix strip, the metafile
+	// rewrite) must key off this value, not buildOptions.Outdir, since a
+	// reused context's Rebuild result still reports paths under the Outdir
+	// it was originally created with.
+	var (
+		result      api.BuildResult
+		buildOutdir string
+	)
 
-			}
+	if opts.Incremental {
+		ctxKey := internal.NewResourceTransformationKey("jsbuild-incremental", buildOptions.EntryPoints, optsm).Value()
 
-			if err == nil {
-				fe := herrors.
-					NewFileErrorFromName(errors.New(errorMessage), path).
-					UpdatePosition(text.Position{Offset: -1, LineNumber: loc.Line, ColumnNumber: loc.Column}).
-					UpdateContent(f, nil)
+		var err error
+		result, buildOutdir, err = c.buildIncremental(buildOptions, ctxKey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		outdir, err := os.MkdirTemp(os.TempDir(), "compileOutput")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(outdir)
 
-				f.Close()
-				return fe
-			}
+		buildOptions.Outdir = outdir
+		buildOutdir = outdir
 
-			return fmt.Errorf("%s", errorMessage)
-		}
+		result = api.Build(buildOptions)
+	}
 
+	if len(result.Errors) > 0 {
 		var errors []error
 
 		for _, msg := range result.Errors {
-			errors = append(errors, createErr(msg))
+			errors = append(errors, c.toBuildError(msg))
 		}
 
 		// Return 1, log the rest.
@@ -189,7 +587,7 @@ func (c *Client) Transform(optsm map[string]any, r []resources.ResourceTransform
 		name = strings.TrimSuffix(name, filepath.Ext(name))
 
 		// add tmp dir prefix
-		name = filepath.Join(buildOptions.Outdir, name)
+		name = filepath.Join(buildOutdir, name)
 		nameJS := name + ".js"
 
 		// add entry point to map
@@ -222,7 +620,7 @@ func (c *Client) Transform(optsm map[string]any, r []resources.ResourceTransform
 	for _, f := range result.OutputFiles {
 		realPath := f.Path
 
-		path := strings.TrimPrefix(f.Path, buildOptions.Outdir)
+		path := strings.TrimPrefix(f.Path, buildOutdir)
 		path = filepath.Join(outDir, path)
 		f.Path = path
 
@@ -279,9 +677,90 @@ func (c *Client) Transform(optsm map[string]any, r []resources.ResourceTransform
 		}
 	}
 
+	if opts.Metafile {
+		metafile, err := rewriteMetafilePaths(result.Metafile, buildOutdir, outDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process metafile: %w", err)
+		}
+
+		c.metafileMu.Lock()
+		c.lastMetafile = metafile
+		c.metafileMu.Unlock()
+
+		metafilePath := opts.MetafilePath
+		if metafilePath == "" {
+			metafilePath = filepath.Join(addlFilesBase, outDir, "metafile.json")
+		}
+
+		if err := c.Publish(metafilePath, metafile); err != nil {
+			return nil, err
+		}
+	}
+
 	return res, nil
 }
 
+// rewriteMetafilePaths rewrites the Outdir-prefixed paths in an esbuild
+// metafile (see api.BuildOptions.Metafile) so that they point to the paths
+// Hugo publishes to rather than esbuild's temporary build directory.
+func rewriteMetafilePaths(metafile, outdir, outDir string) (string, error) {
+	var m map[string]any
+	if err := json.Unmarshal([]byte(metafile), &m); err != nil {
+		return "", err
+	}
+
+	// rewritePath leaves paths that aren't Outdir-prefixed (e.g. a bare
+	// external package specifier recorded in an import entry) untouched.
+	rewritePath := func(p string) string {
+		if !strings.HasPrefix(p, outdir) {
+			return p
+		}
+		return filepath.ToSlash(filepath.Join(outDir, strings.TrimPrefix(p, outdir)))
+	}
+
+	if outputs, ok := m["outputs"].(map[string]any); ok {
+		rewritten := make(map[string]any, len(outputs))
+		for path, v := range outputs {
+			if vm, ok := v.(map[string]any); ok {
+				if entryPoint, ok := vm["entryPoint"].(string); ok {
+					vm["entryPoint"] = rewritePath(entryPoint)
+				}
+				if cssBundle, ok := vm["cssBundle"].(string); ok {
+					vm["cssBundle"] = rewritePath(cssBundle)
+				}
+				if imports, ok := vm["imports"].([]any); ok {
+					for _, imp := range imports {
+						if impm, ok := imp.(map[string]any); ok {
+							if importPath, ok := impm["path"].(string); ok {
+								impm["path"] = rewritePath(importPath)
+							}
+						}
+					}
+				}
+			}
+			rewritten[rewritePath(path)] = v
+		}
+		m["outputs"] = rewritten
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// LastMetafile returns the esbuild metafile JSON (see
+// https://esbuild.github.io/api/#metafile) produced by the most recent
+// Transform call made with Options.Metafile enabled, or the empty string if
+// no such call has been made yet.
+func (c *Client) LastMetafile() string {
+	c.metafileMu.RLock()
+	defer c.metafileMu.RUnlock()
+	return c.lastMetafile
+}
+
 type entrypointTransformation struct {
 	optsm map[string]any
 }
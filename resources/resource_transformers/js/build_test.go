@@ -0,0 +1,280 @@
+// Copyright 2020 The Hugo Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package js
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/gohugoio/hugo/common/herrors"
+	qt "github.com/frankban/quicktest"
+)
+
+// TestVirtualModulePlugin verifies that a plugin passed in via
+// Options.Plugins is honoured by toBuildOptions and esbuild, by resolving
+// and loading a "virtual:" import that has no file on disk.
+func TestVirtualModulePlugin(t *testing.T) {
+	c := qt.New(t)
+
+	virtualPlugin := api.Plugin{
+		Name: "virtual",
+		Setup: func(build api.PluginBuild) {
+			build.OnResolve(api.OnResolveOptions{Filter: `^virtual:`},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					return api.OnResolveResult{Path: args.Path, Namespace: "virtual"}, nil
+				})
+			build.OnLoad(api.OnLoadOptions{Filter: `.*`, Namespace: "virtual"},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					contents := `export const generated = "hello from a virtual module";`
+					return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+				})
+		},
+	}
+
+	buildOptions, err := toBuildOptions(Options{Plugins: []api.Plugin{virtualPlugin}})
+	c.Assert(err, qt.IsNil)
+	c.Assert(buildOptions.Plugins, qt.HasLen, 1)
+
+	buildOptions.Bundle = true
+	buildOptions.Write = false
+	buildOptions.Stdin = &api.StdinOptions{
+		Contents:   `import { generated } from "virtual:generated.js"; console.log(generated);`,
+		Loader:     api.LoaderJS,
+		ResolveDir: ".",
+	}
+
+	result := api.Build(buildOptions)
+	c.Assert(result.Errors, qt.HasLen, 0)
+	c.Assert(string(result.OutputFiles[0].Contents), qt.Contains, "hello from a virtual module")
+}
+
+// TestClientBuildIncrementalReusesOutdir verifies that a second
+// buildIncremental call with the same cache key reuses the build context
+// created by the first one, and that the Outdir returned alongside the
+// result is the one the reused context was created with, not a new one.
+func TestClientBuildIncrementalReusesOutdir(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.js")
+	c.Assert(os.WriteFile(entry, []byte(`console.log("hello");`), 0o644), qt.IsNil)
+
+	buildOptions := api.BuildOptions{
+		EntryPoints: []string{entry},
+		Bundle:      true,
+		Write:       false,
+	}
+
+	client := &Client{}
+	defer client.Close()
+
+	result1, outdir1, err := client.buildIncremental(buildOptions, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result1.Errors, qt.HasLen, 0)
+	c.Assert(outdir1, qt.Not(qt.Equals), "")
+	c.Assert(client.contexts, qt.HasLen, 1)
+
+	result2, outdir2, err := client.buildIncremental(buildOptions, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(result2.Errors, qt.HasLen, 0)
+	c.Assert(outdir2, qt.Equals, outdir1)
+	c.Assert(client.contexts, qt.HasLen, 1)
+}
+
+// TestClientToBuildErrorPreservesPositionForPluginNamespace verifies that an
+// error raised for a path served by a plugin-registered namespace (which has
+// no file on disk to read context from) still carries the line/column
+// position esbuild reported, rather than collapsing into a plain error.
+func TestClientToBuildErrorPreservesPositionForPluginNamespace(t *testing.T) {
+	c := qt.New(t)
+
+	client := &Client{}
+	msg := api.Message{
+		Text: "it broke",
+		Location: &api.Location{
+			File:   "virtual:generated.js",
+			Line:   3,
+			Column: 7,
+		},
+	}
+
+	err := client.toBuildError(msg)
+
+	fe, ok := err.(herrors.FileError)
+	c.Assert(ok, qt.IsTrue)
+	pos := fe.Position()
+	c.Assert(pos.LineNumber, qt.Equals, 3)
+	c.Assert(pos.ColumnNumber, qt.Equals, 7)
+}
+
+func TestClientCloseWithNoIncrementalBuilds(t *testing.T) {
+	c := qt.New(t)
+
+	client := &Client{}
+	c.Assert(client.Close(), qt.IsNil)
+	client.InvalidateIncremental()
+}
+
+// fakeBuildContext is a minimal api.BuildContext double used to verify that
+// Close disposes every cached context; constructing a real one would start
+// an esbuild build.
+type fakeBuildContext struct {
+	disposed bool
+}
+
+func (f *fakeBuildContext) Rebuild() api.BuildResult               { return api.BuildResult{} }
+func (f *fakeBuildContext) Watch(api.WatchOptions) error           { return nil }
+func (f *fakeBuildContext) Serve(api.ServeOptions) (api.ServeResult, error) {
+	return api.ServeResult{}, nil
+}
+func (f *fakeBuildContext) Cancel()  {}
+func (f *fakeBuildContext) Dispose() { f.disposed = true }
+
+// TestClientCloseDisposesContextsAndRemovesOutdir verifies that Close (and,
+// via it, InvalidateIncremental) actually dispose every cached esbuild
+// context and remove the Outdir it was using, rather than just clearing the
+// registry and leaking both.
+func TestClientCloseDisposesContextsAndRemovesOutdir(t *testing.T) {
+	c := qt.New(t)
+
+	outdir := t.TempDir()
+	fake := &fakeBuildContext{}
+	client := &Client{
+		contexts: map[string]*incrementalContext{
+			"key": {ctx: fake, outdir: outdir},
+		},
+	}
+
+	c.Assert(client.Close(), qt.IsNil)
+	c.Assert(fake.disposed, qt.IsTrue)
+	c.Assert(client.contexts, qt.HasLen, 0)
+	_, err := os.Stat(outdir)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+// blockingBuildContext is an api.BuildContext double whose Rebuild blocks
+// until told to proceed, used to prove buildIncremental releases contextsMu
+// before calling Rebuild.
+type blockingBuildContext struct {
+	rebuildStarted chan struct{}
+	proceed        chan struct{}
+}
+
+func (b *blockingBuildContext) Rebuild() api.BuildResult {
+	close(b.rebuildStarted)
+	<-b.proceed
+	return api.BuildResult{}
+}
+
+func (b *blockingBuildContext) Watch(api.WatchOptions) error { return nil }
+func (b *blockingBuildContext) Serve(api.ServeOptions) (api.ServeResult, error) {
+	return api.ServeResult{}, nil
+}
+func (b *blockingBuildContext) Cancel()  {}
+func (b *blockingBuildContext) Dispose() {}
+
+// TestClientBuildIncrementalDoesNotHoldLockDuringRebuild verifies that
+// buildIncremental releases contextsMu before calling Rebuild, so a
+// long-running rebuild for one cache key doesn't block unrelated registry
+// access for another.
+func TestClientBuildIncrementalDoesNotHoldLockDuringRebuild(t *testing.T) {
+	c := qt.New(t)
+
+	blocking := &blockingBuildContext{
+		rebuildStarted: make(chan struct{}),
+		proceed:        make(chan struct{}),
+	}
+	client := &Client{
+		contexts: map[string]*incrementalContext{
+			"key": {ctx: blocking, outdir: t.TempDir()},
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		client.buildIncremental(api.BuildOptions{}, "key")
+		close(done)
+	}()
+
+	<-blocking.rebuildStarted
+
+	lockAcquired := make(chan struct{})
+	go func() {
+		client.contextsMu.Lock()
+		client.contextsMu.Unlock()
+		close(lockAcquired)
+	}()
+
+	select {
+	case <-lockAcquired:
+	case <-time.After(time.Second):
+		c.Fatal("contextsMu is still held while Rebuild is in progress")
+	}
+
+	close(blocking.proceed)
+	<-done
+}
+
+func TestRewriteMetafilePaths(t *testing.T) {
+	c := qt.New(t)
+
+	metafile := `{
+		"inputs": {},
+		"outputs": {
+			"/tmp/compileOutput123/main.js": {
+				"bytes": 42,
+				"entryPoint": "/tmp/compileOutput123/main.js"
+			}
+		}
+	}`
+
+	got, err := rewriteMetafilePaths(metafile, "/tmp/compileOutput123", "js")
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.Contains, `"js/main.js"`)
+	c.Assert(got, qt.Contains, `"entryPoint":"js/main.js"`)
+}
+
+// TestRewriteMetafilePathsCSSBundleAndImports verifies that cssBundle and
+// imports[].path are rewritten alongside entryPoint, and that a path that
+// isn't Outdir-prefixed (e.g. a bare external package specifier) is left
+// untouched rather than corrupted.
+func TestRewriteMetafilePathsCSSBundleAndImports(t *testing.T) {
+	c := qt.New(t)
+
+	metafile := `{
+		"inputs": {},
+		"outputs": {
+			"/tmp/compileOutput123/main.js": {
+				"bytes": 42,
+				"entryPoint": "/tmp/compileOutput123/main.js",
+				"cssBundle": "/tmp/compileOutput123/main.css",
+				"imports": [
+					{"path": "/tmp/compileOutput123/chunk.js"},
+					{"path": "react"}
+				]
+			}
+		}
+	}`
+
+	got, err := rewriteMetafilePaths(metafile, "/tmp/compileOutput123", "js")
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.Contains, `"js/main.js"`)
+	c.Assert(got, qt.Contains, `"entryPoint":"js/main.js"`)
+	c.Assert(got, qt.Contains, `"cssBundle":"js/main.css"`)
+	c.Assert(got, qt.Contains, `"path":"js/chunk.js"`)
+	c.Assert(got, qt.Contains, `"path":"react"`)
+}
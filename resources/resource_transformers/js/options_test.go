@@ -130,6 +130,17 @@ func TestToBuildOptions(t *testing.T) {
 		JSX:             api.JSXAutomatic,
 		JSXImportSource: "preact",
 	})
+
+	opts, err = toBuildOptions(Options{
+		Metafile: true,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(opts, qt.DeepEquals, api.BuildOptions{
+		Bundle:   true,
+		Target:   api.ESNext,
+		Format:   api.FormatIIFE,
+		Metafile: true,
+	})
 }
 
 func TestToBuildOptionsTarget(t *testing.T) {
@@ -161,6 +172,30 @@ func TestToBuildOptionsTarget(t *testing.T) {
 	}
 }
 
+func TestNamespaceFromPath(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		path     string
+		wantNS   string
+		wantRest string
+		wantOK   bool
+	}{
+		{"ns-hugo:foo.js", "ns-hugo", "foo.js", true},
+		{"virtual:generated.js", "virtual", "generated.js", true},
+		{"/assets/foo.js", "", "/assets/foo.js", false},
+		{"foo.js", "", "foo.js", false},
+		{`C:\foo.js`, "", `C:\foo.js`, false},
+	} {
+		c.Run(test.path, func(c *qt.C) {
+			ns, rest, ok := namespaceFromPath(test.path)
+			c.Assert(ok, qt.Equals, test.wantOK)
+			c.Assert(ns, qt.Equals, test.wantNS)
+			c.Assert(rest, qt.Equals, test.wantRest)
+		})
+	}
+}
+
 func TestResolveComponentInAssets(t *testing.T) {
 	c := qt.New(t)
 